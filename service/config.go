@@ -12,13 +12,16 @@ import (
 )
 
 type Config struct {
-    Addr              string
-    RulesDir          string
-    WindowMaxFacts    int
-    PhashHammingMax   int
-    FreshDays         int
-    OCRTitleMin       float64
-    OCRSetMin         float64
+    Addr               string
+    RulesDir           string
+    WindowMaxFacts     int
+    PhashHammingMax    int
+    FreshDays          int
+    OCRTitleMin        float64
+    OCRSetMin          float64
+    QueryTimeoutMSDefault int
+    StoreBackend       string
+    StoreDBPath        string
 }
 
 func loadConfig() (Config, error) {
@@ -30,6 +33,9 @@ func loadConfig() (Config, error) {
         FreshDays:       getEnvInt("FRESH_DAYS", 7),
         OCRTitleMin:     getEnvFloat("OCR_TITLE_MIN", 0.93),
         OCRSetMin:       getEnvFloat("OCR_SET_MIN", 0.90),
+        QueryTimeoutMSDefault: getEnvInt("QUERY_TIMEOUT_MS", 5000),
+        StoreBackend:    getEnv("MANGLE_STORE_BACKEND", "memory"),
+        StoreDBPath:     getEnv("MANGLE_STORE_PATH", ""),
     }
     // Fail fast on nonsensical bounds
     if c.PhashHammingMax < 0 || c.PhashHammingMax > 64 {
@@ -41,6 +47,14 @@ func loadConfig() (Config, error) {
     if c.OCRTitleMin < 0 || c.OCRTitleMin > 1 || c.OCRSetMin < 0 || c.OCRSetMin > 1 {
         return c, fmt.Errorf("OCR_*_MIN must be in [0,1]")
     }
+    if c.QueryTimeoutMSDefault <= 0 {
+        return c, fmt.Errorf("QUERY_TIMEOUT_MS must be > 0")
+    }
+    switch c.StoreBackend {
+    case "memory", "bolt", "sqlite":
+    default:
+        return c, fmt.Errorf("MANGLE_STORE_BACKEND must be one of memory, bolt, sqlite")
+    }
     return c, nil
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "encoding/json"
     "errors"
     "fmt"
@@ -21,23 +22,34 @@ type LoadFactsRequest struct {
     RulesetHash string `json:"ruleset_hash"`
 }
 
+type ApplyDeltaRequest struct {
+    Add    []Fact `json:"add"`
+    Remove []Fact `json:"remove"`
+}
+
 type QueryRequest struct {
-    Predicate string        `json:"predicate"`
-    Args      []interface{} `json:"args"`
-    Explain   bool          `json:"explain"`
-    Limit     int           `json:"limit"`
+    Predicate    string        `json:"predicate"`
+    Args         []interface{} `json:"args"`
+    Explain      bool          `json:"explain"`
+    ExplainDepth int           `json:"explain_depth"`
+    Limit        int           `json:"limit"`
+    TimeoutMS    int           `json:"timeout_ms"`
 }
 
 type Row = []interface{}
 
 type QueryResponse struct {
-    Rows       []Row        `json:"rows"`
-    Derivation []Derivation `json:"derivation,omitempty"`
+    Rows       []Row             `json:"rows"`
+    Derivation []*DerivationTree `json:"derivation,omitempty"`
 }
 
-type Derivation struct {
-    RuleID string `json:"rule_id"`
-    Inputs []Fact `json:"inputs"`
+// Event is one insert/retract of a derived atom streamed by /watch.
+type Event struct {
+    Predicate  string          `json:"predicate"`
+    Op         string          `json:"op"`
+    Args       []interface{}   `json:"args"`
+    Seq        int64           `json:"seq"`
+    Derivation *DerivationTree `json:"derivation,omitempty"`
 }
 
 var svc *RulesService
@@ -51,11 +63,17 @@ func SetupRouter(cfg Config) http.Handler {
             "status": "ok",
             "config": cfg,
             "ruleset_hash": svc.rulesHash,
+            "delta_seq": svc.DeltaSeq(),
         })
     })
-    mux.HandleFunc("/metrics", handleMetrics)
+    mux.HandleFunc("/metrics", handlePrometheusMetrics)
+    mux.HandleFunc("/metrics.json", handleMetrics)
     mux.HandleFunc("/facts:load", handleLoadFacts)
+    mux.HandleFunc("/facts:apply", handleApplyDelta)
+    mux.HandleFunc("/facts:snapshot", handleSnapshot)
+    mux.HandleFunc("/facts:restore", handleRestore)
     mux.HandleFunc("/query", handleQuery)
+    mux.HandleFunc("/watch", handleWatch)
     return mux
 }
 
@@ -67,11 +85,12 @@ func handleLoadFacts(w http.ResponseWriter, r *http.Request) {
     }
 
     start := time.Now()
-    if err := svc.LoadRulesIfNeeded(); err != nil {
+    ctx := r.Context()
+    if err := svc.LoadRulesIfNeeded(ctx); err != nil {
         http.Error(w, fmt.Sprintf("rules error: %v", err), http.StatusBadRequest)
         return
     }
-    if err := svc.LoadFacts(req.Facts); err != nil {
+    if err := svc.LoadFacts(ctx, req.Facts); err != nil {
         var bad *ErrBadFact
         if errors.As(err, &bad) {
             http.Error(w, bad.Error(), http.StatusBadRequest)
@@ -80,13 +99,122 @@ func handleLoadFacts(w http.ResponseWriter, r *http.Request) {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
-    ms := time.Since(start).Milliseconds()
+    elapsed := time.Since(start)
     atomic.AddInt64(&metricsFactsLoadCount, 1)
-    metricsLastFactsLoadMS = int(ms)
-    log.Printf("facts_load predicate=all facts=%d ms=%d ruleset_hash=%s", len(req.Facts), ms, svc.rulesHash)
+    metricsLastFactsLoadMS = int(elapsed.Milliseconds())
+    promFactsLoadDuration.observe(elapsed.Seconds())
+    log.Printf("facts_load predicate=all facts=%d ms=%d ruleset_hash=%s", len(req.Facts), elapsed.Milliseconds(), svc.rulesHash)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func handleApplyDelta(w http.ResponseWriter, r *http.Request) {
+    var req ApplyDeltaRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    start := time.Now()
+    ctx := r.Context()
+    if err := svc.LoadRulesIfNeeded(ctx); err != nil {
+        http.Error(w, fmt.Sprintf("rules error: %v", err), http.StatusBadRequest)
+        return
+    }
+    if err := svc.ApplyDelta(ctx, req.Add, req.Remove); err != nil {
+        var bad *ErrBadFact
+        if errors.As(err, &bad) {
+            http.Error(w, bad.Error(), http.StatusBadRequest)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    ms := time.Since(start).Milliseconds()
+    log.Printf("facts_apply add=%d remove=%d ms=%d delta_seq=%d", len(req.Add), len(req.Remove), ms, svc.DeltaSeq())
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"delta_seq": svc.DeltaSeq()})
+}
+
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+    if err := svc.LoadRulesIfNeeded(r.Context()); err != nil {
+        http.Error(w, fmt.Sprintf("rules error: %v", err), http.StatusBadRequest)
+        return
+    }
+    if err := svc.SnapshotStore(); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
     w.WriteHeader(http.StatusNoContent)
 }
 
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+    if err := svc.LoadRulesIfNeeded(r.Context()); err != nil {
+        http.Error(w, fmt.Sprintf("rules error: %v", err), http.StatusBadRequest)
+        return
+    }
+    restored, err := svc.RestoreStore()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"restored": restored})
+}
+
+// handleWatch streams inserts/retractions of a derived predicate as
+// Server-Sent Events for as long as the client stays connected.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+    pred := r.URL.Query().Get("predicate")
+    if pred == "" {
+        http.Error(w, "predicate required", http.StatusBadRequest)
+        return
+    }
+    var filter []interface{}
+    if raw := r.URL.Query().Get("args"); raw != "" {
+        if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+            http.Error(w, fmt.Sprintf("invalid args: %v", err), http.StatusBadRequest)
+            return
+        }
+    }
+    explain := r.URL.Query().Get("explain") == "true"
+
+    ch, cancel, err := svc.Watch(pred, filter, explain)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    defer cancel()
+
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    log.Printf("watch subscribed predicate=%s explain=%v", pred, explain)
+    for {
+        select {
+        case ev, ok := <-ch:
+            if !ok {
+                return
+            }
+            b, err := json.Marshal(ev)
+            if err != nil {
+                log.Printf("watch: encode event: %v", err)
+                continue
+            }
+            fmt.Fprintf(w, "data: %s\n\n", b)
+            flusher.Flush()
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
 func handleQuery(w http.ResponseWriter, r *http.Request) {
     var req QueryRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -94,12 +222,27 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
         return
     }
     start := time.Now()
-    rows, deriv, err := svc.Query(req)
+    timeoutMS := req.TimeoutMS
+    if timeoutMS <= 0 {
+        timeoutMS = svc.cfg.QueryTimeoutMSDefault
+    }
+    ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeoutMS)*time.Millisecond)
+    defer cancel()
+    rows, deriv, err := svc.Query(ctx, req)
     if err != nil {
+        if errors.Is(err, context.DeadlineExceeded) {
+            atomic.AddInt64(&metricsQueriesTimedOut, 1)
+            promQueryTotal.inc(queryLabelKey(queryMetricPredicate(req.Predicate), "timeout"))
+            promQueryDuration.observe(time.Since(start).Seconds())
+            http.Error(w, "query_timed_out", http.StatusGatewayTimeout)
+            return
+        }
         code := http.StatusBadRequest
         if strings.HasPrefix(err.Error(), "invalid_arg") || strings.HasPrefix(err.Error(), "wrong_arity") {
             code = http.StatusUnprocessableEntity
         }
+        promQueryTotal.inc(queryLabelKey(queryMetricPredicate(req.Predicate), "error"))
+        promQueryDuration.observe(time.Since(start).Seconds())
         http.Error(w, err.Error(), code)
         return
     }
@@ -111,25 +254,91 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
     if err := json.NewEncoder(w).Encode(resp); err != nil {
         log.Printf("encode resp: %v", err)
     }
-    ms := time.Since(start).Milliseconds()
+    elapsed := time.Since(start)
     atomic.AddInt64(&metricsQueryCount, 1)
-    metricsLastQueryMS = int(ms)
-    log.Printf("query predicate=%s args=%v rows=%d explain=%v ms=%d facts=%d", req.Predicate, req.Args, len(rows), req.Explain, ms, svc.store.EstimateFactCount())
+    metricsLastQueryMS = int(elapsed.Milliseconds())
+    promQueryTotal.inc(queryLabelKey(queryMetricPredicate(req.Predicate), "ok"))
+    promQueryDuration.observe(elapsed.Seconds())
+    log.Printf("query predicate=%s args=%v rows=%d explain=%v ms=%d facts=%d", req.Predicate, req.Args, len(rows), req.Explain, elapsed.Milliseconds(), svc.store.EstimateFactCount())
 }
 
 var (
-    metricsQueryCount     int64
-    metricsFactsLoadCount int64
-    metricsLastQueryMS    int
+    metricsQueryCount      int64
+    metricsFactsLoadCount  int64
+    metricsLastQueryMS     int
     metricsLastFactsLoadMS int
+    metricsQueriesTimedOut int64
 )
 
 func handleMetrics(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]any{
         "queries_total": atomic.LoadInt64(&metricsQueryCount),
+        "queries_timed_out_total": atomic.LoadInt64(&metricsQueriesTimedOut),
         "facts_load_total": atomic.LoadInt64(&metricsFactsLoadCount),
         "last_query_ms": metricsLastQueryMS,
         "last_facts_load_ms": metricsLastFactsLoadMS,
     })
 }
+
+// handlePrometheusMetrics exposes the same counters (plus histograms the
+// JSON endpoint never had room for) in Prometheus text exposition format.
+func handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+    var b strings.Builder
+
+    fmt.Fprintln(&b, "# HELP mangle_query_total Total queries handled, by predicate and status.")
+    fmt.Fprintln(&b, "# TYPE mangle_query_total counter")
+    for key, count := range promQueryTotal.snapshot() {
+        pred, status := splitLabelKey(key)
+        fmt.Fprintf(&b, "mangle_query_total{predicate=%q,status=%q} %d\n", pred, status, count)
+    }
+
+    writeHistogram(&b, "mangle_query_duration_seconds", "Query latency in seconds.", "", promQueryDuration)
+    writeHistogram(&b, "mangle_facts_load_duration_seconds", "facts:load latency in seconds.", "", promFactsLoadDuration)
+
+    fmt.Fprintln(&b, "# HELP mangle_stratum_eval_duration_seconds Per-stratum evaluation latency in seconds.")
+    fmt.Fprintln(&b, "# TYPE mangle_stratum_eval_duration_seconds histogram")
+    for _, stratum := range promStratumEvalDuration.labels() {
+        writeHistogramSeries(&b, "mangle_stratum_eval_duration_seconds", fmt.Sprintf("stratum=%q", stratum), promStratumEvalDuration.get(stratum))
+    }
+
+    fmt.Fprintln(&b, "# HELP mangle_facts_in_store Facts currently held per predicate.")
+    fmt.Fprintln(&b, "# TYPE mangle_facts_in_store gauge")
+    for pred, count := range svc.FactsInStore() {
+        fmt.Fprintf(&b, "mangle_facts_in_store{predicate=%q} %d\n", pred, count)
+    }
+
+    fmt.Fprintln(&b, "# HELP mangle_rules_reloads_total Total rules reloads.")
+    fmt.Fprintln(&b, "# TYPE mangle_rules_reloads_total counter")
+    fmt.Fprintf(&b, "mangle_rules_reloads_total %d\n", atomic.LoadInt64(&promRulesReloadsTotal))
+
+    fmt.Fprintln(&b, "# HELP mangle_dup_pairs_total Total duplicate-card pairs detected via phash.")
+    fmt.Fprintln(&b, "# TYPE mangle_dup_pairs_total counter")
+    fmt.Fprintf(&b, "mangle_dup_pairs_total %d\n", atomic.LoadInt64(&promDupPairsTotal))
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    w.Write([]byte(b.String()))
+}
+
+// queryMetricPredicate maps an arbitrary caller-supplied predicate to the
+// value used as a metrics label, bucketing anything outside the query
+// whitelist under a fixed "invalid" label. Without this, a caller sending
+// an endless stream of distinct junk predicates (which all fail
+// predicate_not_allowed before validation) could grow promQueryTotal's
+// label cardinality without bound.
+func queryMetricPredicate(predicate string) string {
+    if _, ok := allowedQueryPredicates[predicate]; ok {
+        return predicate
+    }
+    return "invalid"
+}
+
+func queryLabelKey(predicate, status string) string { return predicate + "|" + status }
+
+func splitLabelKey(key string) (predicate, status string) {
+    parts := strings.SplitN(key, "|", 2)
+    if len(parts) != 2 {
+        return key, ""
+    }
+    return parts[0], parts[1]
+}
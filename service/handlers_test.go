@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+// TestQueryMetricPredicateBucketsUnknownValues covers the chunk0-6 fix:
+// an unwhitelisted predicate must never reach promQueryTotal as its own
+// label value, or a caller could grow its cardinality without bound.
+func TestQueryMetricPredicateBucketsUnknownValues(t *testing.T) {
+    cases := map[string]string{
+        "valid_card":    "valid_card",
+        "duplicate_of":  "duplicate_of",
+        "price_for":     "price_for",
+        "drop table;--": "invalid",
+        "":              "invalid",
+    }
+    for predicate, want := range cases {
+        if got := queryMetricPredicate(predicate); got != want {
+            t.Errorf("queryMetricPredicate(%q) = %q, want %q", predicate, got, want)
+        }
+    }
+}
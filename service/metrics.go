@@ -0,0 +1,163 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// Prometheus-format counters and histograms. Kept hand-rolled rather than
+// pulling in prometheus/client_golang, matching this service's otherwise
+// minimal dependency footprint.
+
+var (
+    promQueryTotal          = newLabeledCounter()
+    promRulesReloadsTotal   int64
+    promDupPairsTotal       int64
+    promQueryDuration       = newHistogram()
+    promFactsLoadDuration   = newHistogram()
+    promStratumEvalDuration = newLabeledHistogram()
+)
+
+// defaultBuckets mirrors the Prometheus client library's default bucket
+// boundaries, in seconds.
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// labeledCounter is a set of independent counters keyed by an opaque label
+// string (callers join label values themselves, e.g. "predicate|status").
+type labeledCounter struct {
+    mu     sync.Mutex
+    counts map[string]int64
+}
+
+func newLabeledCounter() *labeledCounter {
+    return &labeledCounter{counts: map[string]int64{}}
+}
+
+func (c *labeledCounter) inc(key string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.counts[key]++
+}
+
+func (c *labeledCounter) snapshot() map[string]int64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    out := make(map[string]int64, len(c.counts))
+    for k, v := range c.counts {
+        out[k] = v
+    }
+    return out
+}
+
+// histogram tracks cumulative ("le") bucket counts alongside sum/count, the
+// shape the Prometheus text exposition format expects.
+type histogram struct {
+    mu     sync.Mutex
+    counts []uint64
+    sum    float64
+    total  uint64
+}
+
+func newHistogram() *histogram {
+    return &histogram{counts: make([]uint64, len(defaultBuckets))}
+}
+
+func (h *histogram) observe(seconds float64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for i, ub := range defaultBuckets {
+        if seconds <= ub {
+            h.counts[i]++
+        }
+    }
+    h.sum += seconds
+    h.total++
+}
+
+func (h *histogram) snapshot() (cumCounts []uint64, sum float64, total uint64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return append([]uint64(nil), h.counts...), h.sum, h.total
+}
+
+// labeledHistogram is one histogram per label value (e.g. per stratum).
+type labeledHistogram struct {
+    mu    sync.Mutex
+    hists map[string]*histogram
+}
+
+func newLabeledHistogram() *labeledHistogram {
+    return &labeledHistogram{hists: map[string]*histogram{}}
+}
+
+func (l *labeledHistogram) observe(label string, seconds float64) {
+    l.mu.Lock()
+    h, ok := l.hists[label]
+    if !ok {
+        h = newHistogram()
+        l.hists[label] = h
+    }
+    l.mu.Unlock()
+    h.observe(seconds)
+}
+
+func (l *labeledHistogram) labels() []string {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    out := make([]string, 0, len(l.hists))
+    for k := range l.hists {
+        out = append(out, k)
+    }
+    sort.Strings(out)
+    return out
+}
+
+func (l *labeledHistogram) get(label string) *histogram {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.hists[label]
+}
+
+func formatFloat(f float64) string {
+    return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeHistogram renders one histogram's HELP/TYPE header and series, with
+// an optional pre-formatted label string (e.g. `stratum="2"`) applied to
+// every line.
+func writeHistogram(b *strings.Builder, name, help, labels string, h *histogram) {
+    fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+    fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+    writeHistogramSeries(b, name, labels, h)
+}
+
+func writeHistogramSeries(b *strings.Builder, name, labels string, h *histogram) {
+    counts, sum, total := h.snapshot()
+    prefix := ""
+    if labels != "" {
+        prefix = labels + ","
+    }
+    for i, ub := range defaultBuckets {
+        fmt.Fprintf(b, "%s_bucket{%sle=%q} %d\n", name, prefix, formatFloat(ub), counts[i])
+    }
+    fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, total)
+    if labels == "" {
+        fmt.Fprintf(b, "%s_sum %s\n", name, formatFloat(sum))
+        fmt.Fprintf(b, "%s_count %d\n", name, total)
+    } else {
+        fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, formatFloat(sum))
+        fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, total)
+    }
+}
+
+func incRulesReloadsTotal() {
+    atomic.AddInt64(&promRulesReloadsTotal, 1)
+}
+
+func incDupPairsTotal() {
+    atomic.AddInt64(&promDupPairsTotal, 1)
+}
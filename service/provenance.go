@@ -0,0 +1,271 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/google/mangle/ast"
+    "github.com/google/mangle/factstore"
+)
+
+// defaultExplainDepth bounds recursion when a caller asks for a derivation
+// tree but doesn't specify how deep to unwind it.
+const defaultExplainDepth = 8
+
+// clauseRef identifies the rule clause (by head predicate and index into
+// RulesService.predToRules) that produced an atom.
+type clauseRef struct {
+    pred ast.PredicateSym
+    idx  int
+}
+
+// provenanceRecord is the why-provenance for one derivation of an atom: the
+// clause that fired, the ground substitution it fired under, and the
+// premise atoms it matched against.
+type provenanceRecord struct {
+    clause   clauseRef
+    bindings map[string]string
+    premises []ast.Atom
+}
+
+// ProvenanceIndex maps a derived atom to the record(s) of how it was
+// derived, built up as an instrumentedStore observes engine.Add calls
+// during evaluation.
+type ProvenanceIndex struct {
+    mu      sync.Mutex
+    records map[string][]provenanceRecord
+}
+
+func newProvenanceIndex() *ProvenanceIndex {
+    return &ProvenanceIndex{records: map[string][]provenanceRecord{}}
+}
+
+func (p *ProvenanceIndex) record(a ast.Atom, rec provenanceRecord) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    key := provenanceKey(a)
+    p.records[key] = append(p.records[key], rec)
+}
+
+func (p *ProvenanceIndex) lookup(a ast.Atom) []provenanceRecord {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.records[provenanceKey(a)]
+}
+
+// clearPredicate drops all recorded derivations for a predicate, used when
+// ApplyDelta re-evaluates the stratum it belongs to and its old provenance
+// may no longer be accurate.
+func (p *ProvenanceIndex) clearPredicate(pred ast.PredicateSym) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    prefix := pred.Symbol + "\x1f"
+    for k := range p.records {
+        if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
+            delete(p.records, k)
+        }
+    }
+}
+
+func provenanceKey(a ast.Atom) string {
+    return a.Predicate.Symbol + "\x1f" + atomKey(a)
+}
+
+// instrumentedStore wraps the service's fact store so that every atom
+// derived during evaluation also gets its provenance recorded, without the
+// engine itself needing to know about provenance. ctx is the same one
+// evalStrata's caller passed in, so a cancelled or timed-out request stops
+// the (re-)derivation walk below, not just the outer per-stratum loop.
+type instrumentedStore struct {
+    factstore.FactStoreWithRemove
+    svc *RulesService
+    ctx context.Context
+    // provenanceOverhead accumulates the time Add spends walking premises
+    // to record a derivation, so evalStrata's per-stratum timer can
+    // subtract it back out and measure evaluation cost on its own. Only
+    // ever touched synchronously from the engine's single eval goroutine.
+    provenanceOverhead time.Duration
+}
+
+func (s *instrumentedStore) Add(a ast.Atom) bool {
+    added := s.FactStoreWithRemove.Add(a)
+    if !added {
+        return added
+    }
+    clauses := s.svc.predToRules[a.Predicate]
+    if len(clauses) == 0 {
+        return added // EDB atom, nothing derived it
+    }
+    start := time.Now()
+    defer func() { s.provenanceOverhead += time.Since(start) }()
+    for idx, clause := range clauses {
+        bindings, premises, ok, err := s.deriveFor(s.ctx, clause, a)
+        if err != nil || !ok {
+            continue
+        }
+        s.svc.provenance.record(a, provenanceRecord{
+            clause:   clauseRef{pred: a.Predicate, idx: idx},
+            bindings: bindings,
+            premises: premises,
+        })
+        break
+    }
+    return added
+}
+
+// deriveFor checks whether clause could have derived atom `derived`, and if
+// so returns the variable bindings and the premise atoms it matched. Only
+// positive atom premises are resolved; negations, comparisons and
+// transforms are skipped, so the resulting tree may be incomplete for
+// clauses that rely on them.
+func (s *instrumentedStore) deriveFor(ctx context.Context, clause ast.Clause, derived ast.Atom) (map[string]string, []ast.Atom, bool, error) {
+    bindings := map[string]string{}
+    if !unifyAtom(clause.Head, derived, bindings) {
+        return nil, nil, false, nil
+    }
+    var premises []ast.Atom
+    for _, term := range clause.Premises {
+        if err := ctx.Err(); err != nil {
+            return nil, nil, false, err
+        }
+        atom, ok := term.(ast.Atom)
+        if !ok {
+            continue
+        }
+        match, found, err := s.findMatchingFact(ctx, atom, bindings)
+        if err != nil {
+            return nil, nil, false, err
+        }
+        if !found {
+            return nil, nil, false, nil
+        }
+        premises = append(premises, match)
+    }
+    return bindings, premises, true, nil
+}
+
+// findMatchingFact scans the store for a fact unifying with pattern under
+// the bindings accumulated so far, extending bindings on success.
+func (s *instrumentedStore) findMatchingFact(ctx context.Context, pattern ast.Atom, bindings map[string]string) (ast.Atom, bool, error) {
+    var result ast.Atom
+    found := false
+    err := s.FactStoreWithRemove.GetFacts(ast.NewQuery(pattern.Predicate), func(cand ast.Atom) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        if found {
+            return nil
+        }
+        trial := make(map[string]string, len(bindings))
+        for k, v := range bindings {
+            trial[k] = v
+        }
+        if unifyAtom(pattern, cand, trial) {
+            for k, v := range trial {
+                bindings[k] = v
+            }
+            result = cand
+            found = true
+        }
+        return nil
+    })
+    if err != nil {
+        return ast.Atom{}, false, err
+    }
+    return result, found, nil
+}
+
+// unifyAtom matches pattern's args against concrete's args, binding pattern
+// variables in `bindings` (consistently with any bindings already present)
+// and requiring constants to match exactly.
+func unifyAtom(pattern, concrete ast.Atom, bindings map[string]string) bool {
+    if len(pattern.Args) != len(concrete.Args) {
+        return false
+    }
+    for i, pa := range pattern.Args {
+        cv := concrete.Args[i].String()
+        v, ok := pa.(ast.Variable)
+        if !ok {
+            if pa.String() != cv {
+                return false
+            }
+            continue
+        }
+        if v.Symbol == "_" {
+            continue
+        }
+        if bound, ok := bindings[v.Symbol]; ok {
+            if bound != cv {
+                return false
+            }
+        } else {
+            bindings[v.Symbol] = cv
+        }
+    }
+    return true
+}
+
+// DerivationTree is the nested why-provenance returned by Explain: the rule
+// clause and bindings that produced an atom, recursing into its premises
+// down to EDB facts or a depth/cycle cutoff.
+type DerivationTree struct {
+    Atom     Fact               `json:"atom"`
+    EDB      bool               `json:"edb,omitempty"`
+    RuleText string             `json:"rule_text,omitempty"`
+    Bindings map[string]string  `json:"bindings,omitempty"`
+    Children []*DerivationTree  `json:"children,omitempty"`
+}
+
+// Explain builds the derivation tree for atom, recursing up to maxDepth
+// premise levels. An atom is expanded at most once per tree: a repeat,
+// whether a cycle back into one of its own ancestors or the same atom
+// reached again through a sibling branch, is returned without children.
+// It respects ctx cancellation/deadlines
+// the same way Query and LoadFacts do, since a deep or wide tree can do
+// substantial work per node.
+func (r *RulesService) Explain(ctx context.Context, atom ast.Atom, maxDepth int) (*DerivationTree, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    if r.program == nil {
+        return nil, fmt.Errorf("rules not loaded")
+    }
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return r.explainAtom(ctx, atom, maxDepth, map[string]bool{})
+}
+
+func (r *RulesService) explainAtom(ctx context.Context, a ast.Atom, depth int, visited map[string]bool) (*DerivationTree, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    node := &DerivationTree{Atom: atomToFact(a)}
+    if _, ok := r.predToRules[a.Predicate]; !ok {
+        node.EDB = true
+        return node, nil
+    }
+    key := provenanceKey(a)
+    if visited[key] || depth <= 0 {
+        return node, nil
+    }
+    visited[key] = true
+    recs := r.provenance.lookup(a)
+    if len(recs) == 0 {
+        return node, nil
+    }
+    rec := recs[0]
+    if clauses := r.predToRules[rec.clause.pred]; rec.clause.idx < len(clauses) {
+        node.RuleText = fmt.Sprintf("%v", clauses[rec.clause.idx])
+    }
+    node.Bindings = rec.bindings
+    for _, premise := range rec.premises {
+        child, err := r.explainAtom(ctx, premise, depth-1, visited)
+        if err != nil {
+            return nil, err
+        }
+        node.Children = append(node.Children, child)
+    }
+    return node, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    "github.com/google/mangle/analysis"
+    "github.com/google/mangle/ast"
+)
+
+// TestExplainRespectsContext checks that Explain builds a derivation tree
+// from recorded provenance and that the derivation walk fails fast on an
+// already-cancelled ctx instead of doing unbounded work.
+func TestExplainRespectsContext(t *testing.T) {
+    validCard := ast.PredicateSym{Symbol: "valid_card", Arity: 1}
+    ocrField := ast.PredicateSym{Symbol: "ocr_field", Arity: 2}
+    clause := ast.Clause{Head: ast.Atom{Predicate: validCard, Args: []ast.BaseTerm{ast.Variable{Symbol: "Id"}}}}
+
+    r := &RulesService{
+        program:     &analysis.ProgramInfo{},
+        predToRules: map[ast.PredicateSym][]ast.Clause{validCard: {clause}},
+        provenance:  newProvenanceIndex(),
+    }
+    atom := ast.Atom{Predicate: validCard, Args: []ast.BaseTerm{ast.String("c1")}}
+    premise := ast.Atom{Predicate: ocrField, Args: []ast.BaseTerm{ast.String("c1"), ast.String("ok")}}
+    r.provenance.record(atom, provenanceRecord{
+        clause:   clauseRef{pred: validCard, idx: 0},
+        bindings: map[string]string{"Id": "c1"},
+        premises: []ast.Atom{premise},
+    })
+
+    tree, err := r.Explain(context.Background(), atom, defaultExplainDepth)
+    if err != nil {
+        t.Fatalf("Explain: %v", err)
+    }
+    if len(tree.Children) != 1 || !tree.Children[0].EDB {
+        t.Fatalf("expected one EDB child derived from provenance, got %+v", tree)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if _, err := r.Explain(ctx, atom, defaultExplainDepth); err == nil {
+        t.Fatalf("expected Explain to fail fast on an already-cancelled context")
+    }
+}
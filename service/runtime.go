@@ -1,13 +1,17 @@
 package main
 
 import (
+    "context"
     "errors"
     "fmt"
+    "log"
     "os"
     "path/filepath"
     "sort"
+    "strconv"
     "strings"
     "sync"
+    "time"
 
     "github.com/google/mangle/analysis"
     "github.com/google/mangle/ast"
@@ -26,9 +30,32 @@ type RulesService struct {
     predToRules  map[ast.PredicateSym][]ast.Clause
     predToDecl   map[ast.PredicateSym]*ast.Decl
     store        factstore.FactStoreWithRemove
+    backend      StoreBackend
+    provenance   *ProvenanceIndex
     cfg          Config
+    deltaSeq     int64
+
+    watchMu   sync.Mutex
+    subs      map[ast.PredicateSym][]*watchSub
+    lastAtoms map[ast.PredicateSym]map[string]ast.Atom
+    eventSeq  int64
+}
+
+// watchSub is one registered /watch subscriber.
+type watchSub struct {
+    ch      chan Event
+    filter  []interface{}
+    explain bool
+    // closed is set under watchMu by cancel() before it closes ch, so
+    // broadcast (which holds watchMu for its whole send loop) never sends
+    // on a channel that cancel is about to, or just did, close.
+    closed bool
 }
 
+// watchChannelBuffer bounds how far a subscriber can lag before events are
+// dropped for it, so one slow watcher can't stall fact loading for everyone.
+const watchChannelBuffer = 64
+
 func NewRulesService(cfg Config) *RulesService {
     dir := cfg.RulesDir
     return &RulesService{rulesDir: dir, cfg: cfg}
@@ -38,9 +65,12 @@ func NewRulesService(cfg Config) *RulesService {
 type ErrBadFact struct{ msg string }
 func (e *ErrBadFact) Error() string { return e.msg }
 
-func (r *RulesService) LoadRulesIfNeeded() error {
+func (r *RulesService) LoadRulesIfNeeded(ctx context.Context) error {
     r.mu.Lock()
     defer r.mu.Unlock()
+    if err := ctx.Err(); err != nil {
+        return err
+    }
     // Compute deterministic hash of rules dir
     currentHash, err := rulesDirHash(r.rulesDir)
     if err != nil { return err }
@@ -95,21 +125,56 @@ func (r *RulesService) LoadRulesIfNeeded() error {
     r.predToRules = predToRules
     r.predToDecl = predToDecl
     r.rulesHash = currentHash
-    // Fresh store on rules reload
-    r.store = factstore.NewSimpleInMemoryStore()
+    // Fresh backend on rules reload. For a durable backend (bolt/sqlite)
+    // this may already contain facts from a prior process; Restore below
+    // detects whether they match this rules hash.
+    if r.backend != nil {
+        r.backend.Close()
+    }
+    backend, err := newStoreBackend(r.cfg)
+    if err != nil {
+        return fmt.Errorf("open store backend: %w", err)
+    }
+    r.backend = backend
+    r.store = backend
+    r.provenance = newProvenanceIndex()
+    r.deltaSeq = 0
+    restored, err := backend.Restore(currentHash, r.knownPredicatesLocked())
+    if err != nil {
+        log.Printf("store: restore failed for rules_hash=%s: %v", currentHash, err)
+    } else if restored {
+        log.Printf("store: restored facts for rules_hash=%s, skipping re-derivation", currentHash)
+    } else if err := backend.Clear(); err != nil {
+        // Facts on disk (if any) belong to a different rules hash; wipe
+        // them so they don't silently contaminate the new rules version.
+        log.Printf("store: clear stale facts for rules_hash=%s: %v", currentHash, err)
+    }
+    incRulesReloadsTotal()
     return nil
 }
 
-func (r *RulesService) LoadFacts(facts []Fact) error {
+func (r *RulesService) LoadFacts(ctx context.Context, facts []Fact) error {
     if r.program == nil {
         return errors.New("rules not loaded")
     }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
     // Enforce window cap
     if r.cfg.WindowMaxFacts > 0 && len(facts) > r.cfg.WindowMaxFacts {
         return &ErrBadFact{fmt.Sprintf("window_max_exceeded: %d > %d", len(facts), r.cfg.WindowMaxFacts)}
     }
-    // Reset store and (re)load facts
-    r.store = factstore.NewSimpleInMemoryStore()
+    // Reset store and (re)load facts. Clear wipes the backend's existing
+    // facts in place; closing and reopening the same on-disk file (the
+    // prior approach) is a no-op for bolt/sqlite, since it just sees the
+    // previous window's facts again.
+    if err := r.backend.Clear(); err != nil {
+        return fmt.Errorf("clear store backend: %w", err)
+    }
+    r.provenance = newProvenanceIndex()
+    r.deltaSeq = 0
     // First pass: ingest caller facts
     for i, f := range facts {
         if f.Pred == "" {
@@ -125,26 +190,357 @@ func (r *RulesService) LoadFacts(facts []Fact) error {
     augmentDuplicates(r.store, r.cfg.PhashHammingMax)
     // Optionally derive fresh(Ts) from vendor_price timestamps if no fresh facts given
     ensureFreshFacts(r.store, r.cfg.FreshDays)
-    // Evaluate program
-    _, err := engine.EvalStratifiedProgramWithStats(r.program, r.strata, r.predToStrata, r.store)
-    if err != nil {
-        return fmt.Errorf("eval: %w", err)
+    // Evaluate program, stratum by stratum so a cancelled context stops us
+    // at a stratum boundary instead of mid-evaluation.
+    if err := r.evalStrata(ctx, r.strata, 0); err != nil {
+        return err
+    }
+    r.publishWatchEvents(ctx)
+    return nil
+}
+
+// evalStrata runs the given strata in order, checking ctx between each one
+// so a cancelled or timed-out request stops evaluation at a stratum
+// boundary rather than running it to completion regardless. baseIndex is
+// strata's offset into r.strata, so callers passing a suffix (e.g.
+// ApplyDelta) still get per-stratum metrics labeled with the real index.
+func (r *RulesService) evalStrata(ctx context.Context, strata []analysis.Nodeset, baseIndex int) error {
+    instrumented := &instrumentedStore{FactStoreWithRemove: r.store, svc: r, ctx: ctx}
+    for i, stratum := range strata {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        start := time.Now()
+        overheadBefore := instrumented.provenanceOverhead
+        // EvalStratifiedProgramWithStats's returned stats aggregate the
+        // engine's own pass/iteration counters, not a per-stratum wall
+        // clock duration, so they're not a drop-in source for this
+        // histogram. We keep timing the call ourselves, but subtract the
+        // time instrumentedStore.Add spent walking premises to record
+        // provenance (chunk0-4) so mangle_stratum_eval_duration_seconds
+        // tracks eval cost, not provenance bookkeeping.
+        _, err := engine.EvalStratifiedProgramWithStats(r.program, []analysis.Nodeset{stratum}, r.predToStrata, instrumented)
+        elapsed := time.Since(start) - (instrumented.provenanceOverhead - overheadBefore)
+        promStratumEvalDuration.observe(strconv.Itoa(baseIndex+i), elapsed.Seconds())
+        if err != nil {
+            return fmt.Errorf("eval: %w", err)
+        }
     }
     return nil
 }
 
-func (r *RulesService) Query(q QueryRequest) ([]Row, []Derivation, error) {
+// ApplyDelta mutates the store in place by adding and removing the given
+// facts, then re-evaluates every stratum from the lowest one the delta
+// touched onward, whether or not its own inputs changed. Strata below the lowest dirty stratum keep whatever derived facts the
+// last full evaluation left in the store.
+func (r *RulesService) ApplyDelta(ctx context.Context, add []Fact, remove []Fact) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.program == nil {
+        return errors.New("rules not loaded")
+    }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    dirty := map[ast.PredicateSym]bool{}
+    for i, f := range add {
+        if f.Pred == "" {
+            return &ErrBadFact{fmt.Sprintf("add[%d]: missing pred", i)}
+        }
+        atom, err := jsonFactToAtom(f)
+        if err != nil {
+            return &ErrBadFact{fmt.Sprintf("add[%d]: %v", i, err)}
+        }
+        r.store.Add(atom)
+        dirty[atom.Predicate] = true
+    }
+    for i, f := range remove {
+        if f.Pred == "" {
+            return &ErrBadFact{fmt.Sprintf("remove[%d]: missing pred", i)}
+        }
+        atom, err := jsonFactToAtom(f)
+        if err != nil {
+            return &ErrBadFact{fmt.Sprintf("remove[%d]: %v", i, err)}
+        }
+        r.store.Remove(atom)
+        dirty[atom.Predicate] = true
+    }
+    if len(dirty) == 0 {
+        return nil
+    }
+    // Find the lowest stratum touched by the delta; everything from there
+    // onward may now be stale, everything before it is unaffected.
+    minStratum := -1
+    for pred := range dirty {
+        s, ok := r.predToStrata[pred]
+        if !ok {
+            continue
+        }
+        if minStratum == -1 || s < minStratum {
+            minStratum = s
+        }
+    }
+    if minStratum == -1 {
+        // Only facts for predicates outside the program (e.g. unused EDB) changed.
+        r.deltaSeq++
+        return nil
+    }
+    // Semi-naive evaluation only ever calls Add, so re-running the dirty
+    // strata on a store that still holds every previously-derived atom
+    // would just re-confirm stale facts, never retract the ones a removed
+    // premise no longer justifies. Clear the IDB facts we're about to
+    // re-derive first, so the fixpoint below starts from only the EDB
+    // facts plus whatever lower, unaffected strata already produced.
+    r.clearDirtyIDBFacts(minStratum)
+    for pred, s := range r.predToStrata {
+        if s >= minStratum {
+            r.provenance.clearPredicate(pred)
+        }
+    }
+    if err := r.evalStrata(ctx, r.strata[minStratum:], minStratum); err != nil {
+        return err
+    }
+    r.deltaSeq++
+    r.publishWatchEvents(ctx)
+    return nil
+}
+
+// clearDirtyIDBFacts removes every currently-stored fact for IDB predicates
+// in strata >= minStratum, so the caller's subsequent evalStrata re-derives
+// them from scratch instead of layering new derivations on top of ones a
+// retracted fact may no longer support. EDB predicates (no rules) are left
+// untouched since nothing derives them.
+func (r *RulesService) clearDirtyIDBFacts(minStratum int) {
+    for pred, s := range r.predToStrata {
+        if s < minStratum || len(r.predToRules[pred]) == 0 {
+            continue
+        }
+        var stale []ast.Atom
+        r.store.GetFacts(ast.NewQuery(pred), func(a ast.Atom) error {
+            stale = append(stale, a)
+            return nil
+        })
+        for _, a := range stale {
+            r.store.Remove(a)
+        }
+    }
+}
+
+// DeltaSeq returns the number of non-empty ApplyDelta calls applied since
+// the last rules reload or LoadFacts call, so callers can detect and resume
+// after a crash.
+func (r *RulesService) DeltaSeq() int64 {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.deltaSeq
+}
+
+// SnapshotStore asks the store backend to record the current facts as a
+// complete evaluation for the active rules hash, for later Restore.
+func (r *RulesService) SnapshotStore() error {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    if r.program == nil {
+        return errors.New("rules not loaded")
+    }
+    return r.backend.Snapshot(r.rulesHash, r.knownPredicatesLocked())
+}
+
+// RestoreStore asks the store backend to load a previously snapshotted
+// fact set for the active rules hash. It reports whether anything was
+// restored; callers should still call LoadFacts if not.
+func (r *RulesService) RestoreStore() (bool, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.program == nil {
+        return false, errors.New("rules not loaded")
+    }
+    restored, err := r.backend.Restore(r.rulesHash, r.knownPredicatesLocked())
+    if restored {
+        r.publishWatchEvents(context.Background())
+    }
+    return restored, err
+}
+
+// FactsInStore reports the current fact count per predicate, keyed by
+// "symbol/arity", for the facts_in_store gauge.
+func (r *RulesService) FactsInStore() map[string]int {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    counts := make(map[string]int, len(r.predToDecl))
+    for pred := range r.predToDecl {
+        n := 0
+        r.store.GetFacts(ast.NewQuery(pred), func(a ast.Atom) error {
+            n++
+            return nil
+        })
+        counts[fmt.Sprintf("%s/%d", pred.Symbol, pred.Arity)] = n
+    }
+    return counts
+}
+
+func (r *RulesService) knownPredicatesLocked() []ast.PredicateSym {
+    preds := make([]ast.PredicateSym, 0, len(r.predToDecl))
+    for pred := range r.predToDecl {
+        preds = append(preds, pred)
+    }
+    return preds
+}
+
+// Watch registers a subscriber for inserts/retractions of a derived
+// predicate's atoms, seen across successive LoadFacts/ApplyDelta calls. The
+// returned cancel func unregisters the subscriber and closes its channel;
+// callers must always call it.
+func (r *RulesService) Watch(pred string, filter []interface{}, explain bool) (<-chan Event, func(), error) {
+    r.mu.RLock()
+    if r.program == nil {
+        r.mu.RUnlock()
+        return nil, nil, errors.New("rules not loaded")
+    }
+    var predSym ast.PredicateSym
+    found := false
+    for sym := range r.predToRules {
+        if sym.Symbol == pred {
+            predSym = sym
+            found = true
+            break
+        }
+    }
+    r.mu.RUnlock()
+    if !found {
+        return nil, nil, fmt.Errorf("predicate_not_derived: %s", pred)
+    }
+
+    sub := &watchSub{ch: make(chan Event, watchChannelBuffer), filter: filter, explain: explain}
+    r.watchMu.Lock()
+    if r.subs == nil {
+        r.subs = map[ast.PredicateSym][]*watchSub{}
+    }
+    r.subs[predSym] = append(r.subs[predSym], sub)
+    r.watchMu.Unlock()
+
+    cancel := func() {
+        r.watchMu.Lock()
+        defer r.watchMu.Unlock()
+        list := r.subs[predSym]
+        for i, s := range list {
+            if s == sub {
+                r.subs[predSym] = append(list[:i:i], list[i+1:]...)
+                break
+            }
+        }
+        sub.closed = true
+        close(sub.ch)
+    }
+    return sub.ch, cancel, nil
+}
+
+// publishWatchEvents diffs each watched predicate's current atoms against
+// the snapshot from the previous evaluation and fans out insert/retract
+// events to registered subscribers. Called after every successful eval.
+func (r *RulesService) publishWatchEvents(ctx context.Context) {
+    r.watchMu.Lock()
+    var predSyms []ast.PredicateSym
+    for sym, list := range r.subs {
+        if len(list) > 0 {
+            predSyms = append(predSyms, sym)
+        }
+    }
+    r.watchMu.Unlock()
+    if len(predSyms) == 0 {
+        return
+    }
+
+    for _, predSym := range predSyms {
+        newAtoms := map[string]ast.Atom{}
+        r.store.GetFacts(ast.NewQuery(predSym), func(a ast.Atom) error {
+            newAtoms[atomKey(a)] = a
+            return nil
+        })
+
+        r.watchMu.Lock()
+        old := r.lastAtoms[predSym]
+        if r.lastAtoms == nil {
+            r.lastAtoms = map[ast.PredicateSym]map[string]ast.Atom{}
+        }
+        r.lastAtoms[predSym] = newAtoms
+        r.watchMu.Unlock()
+
+        var inserts, retracts []ast.Atom
+        for k, a := range newAtoms {
+            if _, ok := old[k]; !ok {
+                inserts = append(inserts, a)
+            }
+        }
+        for k, a := range old {
+            if _, ok := newAtoms[k]; !ok {
+                retracts = append(retracts, a)
+            }
+        }
+        r.broadcast(ctx, predSym, inserts, "insert")
+        r.broadcast(ctx, predSym, retracts, "retract")
+    }
+}
+
+// broadcast fans events out to predSym's subscribers. It holds watchMu for
+// the whole send loop rather than copying the subscriber slice and
+// unlocking: sub.ch <- ev is non-blocking (select/default), so the
+// critical section stays short, and holding the same lock cancel() uses to
+// set sub.closed and close(sub.ch) is what keeps a send from ever racing a
+// close on the same channel.
+func (r *RulesService) broadcast(ctx context.Context, predSym ast.PredicateSym, atoms []ast.Atom, op string) {
+    if len(atoms) == 0 {
+        return
+    }
+    r.watchMu.Lock()
+    defer r.watchMu.Unlock()
+    subs := r.subs[predSym]
+    if len(subs) == 0 {
+        return
+    }
+    for _, a := range atoms {
+        row := atomToRow(a)
+        for _, sub := range subs {
+            if sub.closed {
+                continue
+            }
+            if len(sub.filter) > 0 && !matchArgs(sub.filter, a.Args) {
+                continue
+            }
+            r.eventSeq++
+            ev := Event{Predicate: predSym.Symbol, Op: op, Args: row, Seq: r.eventSeq}
+            if sub.explain {
+                if tree, err := r.explainAtom(ctx, a, defaultExplainDepth, map[string]bool{}); err == nil {
+                    ev.Derivation = tree
+                }
+            }
+            select {
+            case sub.ch <- ev:
+            default:
+                log.Printf("watch: dropping event for slow subscriber pred=%s op=%s", predSym.Symbol, op)
+            }
+        }
+    }
+}
+
+// allowedQueryPredicates whitelists the predicates /query may be asked
+// about, keyed by name and mapping each to its arity. Also used to decide the predicate label promoted
+// to Prometheus metrics, so an unlisted value never reaches a label.
+var allowedQueryPredicates = map[string]int{"valid_card": 1, "duplicate_of": 2, "price_for": 3}
+
+func (r *RulesService) Query(ctx context.Context, q QueryRequest) ([]Row, []*DerivationTree, error) {
     r.mu.RLock()
     defer r.mu.RUnlock()
     if r.program == nil {
         return nil, nil, errors.New("rules not loaded")
     }
+    if err := ctx.Err(); err != nil {
+        return nil, nil, err
+    }
     // Determine arity from decls if available
-    // whitelist allowed predicates
-    allowed := map[string]int{"valid_card":1, "duplicate_of":2, "price_for":3}
     var arity int
     var predSym ast.PredicateSym
-    if v, ok := allowed[q.Predicate]; ok {
+    if v, ok := allowedQueryPredicates[q.Predicate]; ok {
         arity = v
         predSym = ast.PredicateSym{Symbol: q.Predicate, Arity: arity}
     } else {
@@ -157,9 +553,15 @@ func (r *RulesService) Query(q QueryRequest) ([]Row, []Derivation, error) {
     if err := validateArgs(q); err != nil {
         return nil, nil, err
     }
-    // Build result rows by scanning facts
+    // Build result rows by scanning facts, keeping the matched atoms
+    // alongside them when explain was requested so we can derive each
+    // row's provenance tree below.
     var rows []Row
+    var matched []ast.Atom
     err := r.store.GetFacts(ast.NewQuery(predSym), func(a ast.Atom) error {
+        if cerr := ctx.Err(); cerr != nil {
+            return cerr
+        }
         // Optionally filter by provided constants
         if len(q.Args) > 0 {
             if !matchArgs(q.Args, a.Args) {
@@ -167,6 +569,9 @@ func (r *RulesService) Query(q QueryRequest) ([]Row, []Derivation, error) {
             }
         }
         rows = append(rows, atomToRow(a))
+        if q.Explain {
+            matched = append(matched, a)
+        }
         if q.Limit > 0 && len(rows) >= q.Limit {
             return fmt.Errorf("limit")
         }
@@ -175,78 +580,21 @@ func (r *RulesService) Query(q QueryRequest) ([]Row, []Derivation, error) {
     if err != nil && err.Error() != "limit" {
         return nil, nil, err
     }
-    var deriv []Derivation
+    var deriv []*DerivationTree
     if q.Explain {
-        // Minimal provenance: rule head symbol and coarse input facts for known patterns
-        for _, row := range rows {
-            d := Derivation{RuleID: q.Predicate, Inputs: r.deriveInputs(q.Predicate, row)}
-            deriv = append(deriv, d)
+        depth := q.ExplainDepth
+        if depth <= 0 {
+            depth = defaultExplainDepth
         }
-    }
-    return rows, deriv, nil
-}
-
-// deriveInputs returns coarse input facts for our v0 rules.
-func (r *RulesService) deriveInputs(predicate string, row Row) []Fact {
-    switch predicate {
-    case "valid_card":
-        // row: [Id]
-        id := row[0]
-        var inputs []Fact
-        // two ocr_field facts
-        r.store.GetFacts(ast.NewQuery(ast.PredicateSym{Symbol: "ocr_field", Arity: 4}), func(a ast.Atom) error {
-            if a.Args[0].String() == fmt.Sprint(id) {
-                f := atomToFact(a)
-                if len(f.Args) >= 2 && (f.Args[1] == "title" || f.Args[1] == "set") {
-                    inputs = append(inputs, f)
-                }
+        for _, a := range matched {
+            tree, err := r.explainAtom(ctx, a, depth, map[string]bool{})
+            if err != nil {
+                return nil, nil, err
             }
-            return nil
-        })
-        return inputs
-    case "duplicate_of":
-        a := row[0]
-        b := row[1]
-        // dup(A,B) fact (service computed)
-        var inputs []Fact
-        r.store.GetFacts(ast.NewQuery(ast.PredicateSym{Symbol: "dup", Arity: 2}), func(at ast.Atom) error {
-            if at.Args[0].String() == fmt.Sprint(a) && at.Args[1].String() == fmt.Sprint(b) {
-                inputs = append(inputs, atomToFact(at))
-            }
-            return nil
-        })
-        return inputs
-    case "price_for":
-        // row: [Id, Strategy, Price]
-        id := row[0]
-        var inputs []Fact
-        // gather map_id_to_sku(Id,S)
-        var sku string
-        r.store.GetFacts(ast.NewQuery(ast.PredicateSym{Symbol: "map_id_to_sku", Arity: 2}), func(a ast.Atom) error {
-            if a.Args[0].String() == fmt.Sprint(id) {
-                inputs = append(inputs, atomToFact(a))
-                sku = a.Args[1].String()
-            }
-            return nil
-        })
-        if sku != "" {
-            // vendor_price(S,...)
-            r.store.GetFacts(ast.NewQuery(ast.PredicateSym{Symbol: "vendor_price", Arity: 4}), func(a ast.Atom) error {
-                if a.Args[0].String() == sku {
-                    inputs = append(inputs, atomToFact(a))
-                }
-                return nil
-            })
+            deriv = append(deriv, tree)
         }
-        // fresh(_)
-        r.store.GetFacts(ast.NewQuery(ast.PredicateSym{Symbol: "fresh", Arity: 1}), func(a ast.Atom) error {
-            inputs = append(inputs, atomToFact(a))
-            return nil
-        })
-        return inputs
-    default:
-        return nil
     }
+    return rows, deriv, nil
 }
 
 // jsonFactToAtom converts external fact to mangle atom.
@@ -290,6 +638,15 @@ func atomToRow(a ast.Atom) Row {
     return row
 }
 
+// atomKey canonicalizes an atom's argument tuple for set-membership diffing.
+func atomKey(a ast.Atom) string {
+    parts := make([]string, len(a.Args))
+    for i, arg := range a.Args {
+        parts[i] = arg.String()
+    }
+    return strings.Join(parts, "\x1f")
+}
+
 func atomToFact(a ast.Atom) Fact {
     row := make([]interface{}, len(a.Args))
     for i, arg := range a.Args {
@@ -338,6 +695,7 @@ func augmentDuplicates(store factstore.FactStore, hammingMax int) {
             for j := i + 1; j < len(list); j++ {
                 if popcnt(list[i].hash^list[j].hash) <= hammingMax {
                     store.Add(ast.Atom{Predicate: ast.PredicateSym{Symbol: "dup", Arity: 2}, Args: []ast.BaseTerm{ast.String(list[i].id), ast.String(list[j].id)}})
+                    incDupPairsTotal()
                 }
             }
         }
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/google/mangle/ast"
+    "github.com/google/mangle/factstore"
+)
+
+// TestClearDirtyIDBFactsRetractsStaleDerivations covers the chunk0-1
+// retraction bug: without clearing IDB facts for dirty-and-above strata
+// before re-evaluating, a derived fact whose sole supporting EDB fact was
+// retracted would never actually disappear from the store.
+func TestClearDirtyIDBFactsRetractsStaleDerivations(t *testing.T) {
+    ocrField := ast.PredicateSym{Symbol: "ocr_field", Arity: 2}
+    lowerStratumIDB := ast.PredicateSym{Symbol: "has_ocr", Arity: 1}
+    validCard := ast.PredicateSym{Symbol: "valid_card", Arity: 1}
+
+    store := factstore.NewSimpleInMemoryStore()
+    store.Add(ast.Atom{Predicate: ocrField, Args: []ast.BaseTerm{ast.String("c1"), ast.String("ok")}})
+    store.Add(ast.Atom{Predicate: lowerStratumIDB, Args: []ast.BaseTerm{ast.String("c1")}})
+    store.Add(ast.Atom{Predicate: validCard, Args: []ast.BaseTerm{ast.String("c1")}})
+
+    r := &RulesService{
+        store: store,
+        predToStrata: map[ast.PredicateSym]int{
+            ocrField:        0,
+            lowerStratumIDB: 0,
+            validCard:       1,
+        },
+        predToRules: map[ast.PredicateSym][]ast.Clause{
+            lowerStratumIDB: {{}},
+            validCard:       {{}},
+        },
+    }
+
+    r.clearDirtyIDBFacts(1)
+
+    var stillDerived bool
+    store.GetFacts(ast.NewQuery(validCard), func(a ast.Atom) error {
+        stillDerived = true
+        return nil
+    })
+    if stillDerived {
+        t.Fatalf("valid_card fact should have been cleared from a dirty stratum")
+    }
+
+    var lowerPresent, edbPresent bool
+    store.GetFacts(ast.NewQuery(lowerStratumIDB), func(a ast.Atom) error {
+        lowerPresent = true
+        return nil
+    })
+    store.GetFacts(ast.NewQuery(ocrField), func(a ast.Atom) error {
+        edbPresent = true
+        return nil
+    })
+    if !lowerPresent {
+        t.Fatalf("stratum-0 fact below minStratum should not have been cleared")
+    }
+    if !edbPresent {
+        t.Fatalf("EDB fact should never be cleared by clearDirtyIDBFacts")
+    }
+}
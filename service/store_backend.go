@@ -0,0 +1,395 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sync"
+
+    "github.com/google/mangle/ast"
+    "github.com/google/mangle/factstore"
+    bolt "go.etcd.io/bbolt"
+    _ "github.com/mattn/go-sqlite3"
+)
+
+// StoreBackend is a fact store that can additionally snapshot and restore
+// itself across process restarts, keyed by the rules hash it was derived
+// under. Swapping backends trades off durability and scale against the
+// simplicity of the default in-memory store.
+type StoreBackend interface {
+    factstore.FactStoreWithRemove
+    // Snapshot records that the facts currently in the store are a
+    // complete evaluation for rulesHash.
+    Snapshot(rulesHash string, predicates []ast.PredicateSym) error
+    // Restore loads a previously snapshotted fact set for rulesHash, if
+    // one is present and durable across the backend's lifetime. ok is
+    // false if there's nothing to restore (e.g. rules changed, or the
+    // backend doesn't persist across restarts).
+    Restore(rulesHash string, predicates []ast.PredicateSym) (ok bool, err error)
+    // Clear wipes every fact currently held by the backend, including any
+    // on-disk copy for a durable backend. Close+reopen is not equivalent
+    // for bolt/sqlite, since reopening the same path just sees the old
+    // facts again; Clear is what a fresh LoadFacts window needs.
+    Clear() error
+    Close() error
+}
+
+type storeBackendFactory func(cfg Config) (StoreBackend, error)
+
+var storeBackendFactories = map[string]storeBackendFactory{
+    "memory": newMemoryBackend,
+    "bolt":   newBoltBackend,
+    "sqlite": newSQLiteCacheBackend,
+}
+
+func newStoreBackend(cfg Config) (StoreBackend, error) {
+    name := cfg.StoreBackend
+    if name == "" {
+        name = "memory"
+    }
+    f, ok := storeBackendFactories[name]
+    if !ok {
+        return nil, fmt.Errorf("unknown MANGLE_STORE_BACKEND: %s", name)
+    }
+    return f(cfg)
+}
+
+// memoryBackend is the original behavior: a fresh in-memory store every
+// time rules are (re)loaded. It never has anything to restore.
+type memoryBackend struct {
+    factstore.FactStoreWithRemove
+}
+
+func newMemoryBackend(cfg Config) (StoreBackend, error) {
+    return &memoryBackend{FactStoreWithRemove: factstore.NewSimpleInMemoryStore()}, nil
+}
+
+func (m *memoryBackend) Snapshot(rulesHash string, predicates []ast.PredicateSym) error {
+    return nil
+}
+
+func (m *memoryBackend) Restore(rulesHash string, predicates []ast.PredicateSym) (bool, error) {
+    return false, nil
+}
+
+func (m *memoryBackend) Clear() error {
+    m.FactStoreWithRemove = factstore.NewSimpleInMemoryStore()
+    return nil
+}
+
+func (m *memoryBackend) Close() error { return nil }
+
+// boltBackend stores every fact directly in a BoltDB file, one bucket per
+// predicate symbol+arity, so facts survive a process restart without
+// needing a separate snapshot blob. Snapshot/Restore just record and check
+// which rules hash the on-disk facts were derived under.
+type boltBackend struct {
+    db *bolt.DB
+}
+
+const (
+    boltMetaBucket    = "_meta"
+    boltRulesHashKey  = "rules_hash"
+)
+
+func newBoltBackend(cfg Config) (StoreBackend, error) {
+    path := cfg.StoreDBPath
+    if path == "" {
+        path = "rules_brain.bolt"
+    }
+    db, err := bolt.Open(path, 0600, nil)
+    if err != nil {
+        return nil, fmt.Errorf("open bolt store %s: %w", path, err)
+    }
+    return &boltBackend{db: db}, nil
+}
+
+func boltBucketName(pred ast.PredicateSym) []byte {
+    return []byte(fmt.Sprintf("%s#%d", pred.Symbol, pred.Arity))
+}
+
+// Add reports true only once the write has actually committed: bbolt rolls
+// back the whole transaction on any error from the update func, so setting
+// added before Update returns would claim success for a write that never
+// landed.
+func (b *boltBackend) Add(a ast.Atom) bool {
+    isNew := false
+    err := b.db.Update(func(tx *bolt.Tx) error {
+        bucket, err := tx.CreateBucketIfNotExists(boltBucketName(a.Predicate))
+        if err != nil {
+            return err
+        }
+        key := []byte(atomKey(a))
+        if bucket.Get(key) != nil {
+            return nil
+        }
+        val, err := json.Marshal(atomToFact(a))
+        if err != nil {
+            return err
+        }
+        isNew = true
+        return bucket.Put(key, val)
+    })
+    if err != nil {
+        log.Printf("store: bolt add pred=%s: %v", a.Predicate.Symbol, err)
+        return false
+    }
+    return isNew
+}
+
+// Remove mirrors Add: removed is only true once the delete has committed.
+func (b *boltBackend) Remove(a ast.Atom) bool {
+    wasPresent := false
+    err := b.db.Update(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket(boltBucketName(a.Predicate))
+        if bucket == nil {
+            return nil
+        }
+        key := []byte(atomKey(a))
+        if bucket.Get(key) == nil {
+            return nil
+        }
+        wasPresent = true
+        return bucket.Delete(key)
+    })
+    if err != nil {
+        log.Printf("store: bolt remove pred=%s: %v", a.Predicate.Symbol, err)
+        return false
+    }
+    return wasPresent
+}
+
+func (b *boltBackend) GetFacts(query ast.Atom, cb func(ast.Atom) error) error {
+    return b.db.View(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket(boltBucketName(query.Predicate))
+        if bucket == nil {
+            return nil
+        }
+        return bucket.ForEach(func(_, v []byte) error {
+            var f Fact
+            if err := json.Unmarshal(v, &f); err != nil {
+                return err
+            }
+            atom, err := jsonFactToAtom(f)
+            if err != nil {
+                return err
+            }
+            return cb(atom)
+        })
+    })
+}
+
+func (b *boltBackend) EstimateFactCount() int {
+    count := 0
+    b.db.View(func(tx *bolt.Tx) error {
+        return tx.ForEach(func(_ []byte, bucket *bolt.Bucket) error {
+            count += bucket.Stats().KeyN
+            return nil
+        })
+    })
+    return count
+}
+
+func (b *boltBackend) Snapshot(rulesHash string, predicates []ast.PredicateSym) error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        bucket, err := tx.CreateBucketIfNotExists([]byte(boltMetaBucket))
+        if err != nil {
+            return err
+        }
+        return bucket.Put([]byte(boltRulesHashKey), []byte(rulesHash))
+    })
+}
+
+func (b *boltBackend) Restore(rulesHash string, predicates []ast.PredicateSym) (bool, error) {
+    var matched bool
+    err := b.db.View(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(boltMetaBucket))
+        if bucket == nil {
+            return nil
+        }
+        v := bucket.Get([]byte(boltRulesHashKey))
+        matched = v != nil && string(v) == rulesHash
+        return nil
+    })
+    return matched, err
+}
+
+// Clear drops every bucket, including the meta bucket recording the last
+// snapshotted rules hash: wiped facts no longer match whatever was last
+// snapshotted, so Restore should report nothing until Snapshot runs again.
+func (b *boltBackend) Clear() error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        var names [][]byte
+        if err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+            names = append(names, append([]byte(nil), name...))
+            return nil
+        }); err != nil {
+            return err
+        }
+        for _, name := range names {
+            if err := tx.DeleteBucket(name); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func (b *boltBackend) Close() error { return b.db.Close() }
+
+// sqliteCacheBackend is a read-through cache: live fact ops hit an
+// in-memory store, hydrating lazily from SQLite the first time a predicate
+// is queried, and writing through to SQLite on every Add/Remove so the
+// cache can be rebuilt after a restart.
+type sqliteCacheBackend struct {
+    cache  factstore.FactStoreWithRemove
+    db     *sql.DB
+    mu     sync.Mutex
+    loaded map[ast.PredicateSym]bool
+}
+
+func newSQLiteCacheBackend(cfg Config) (StoreBackend, error) {
+    path := cfg.StoreDBPath
+    if path == "" {
+        path = "rules_brain.sqlite"
+    }
+    db, err := sql.Open("sqlite3", path)
+    if err != nil {
+        return nil, fmt.Errorf("open sqlite store %s: %w", path, err)
+    }
+    if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS facts (
+        pred TEXT NOT NULL,
+        arity INTEGER NOT NULL,
+        fact_key TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        PRIMARY KEY (pred, arity, fact_key)
+    )`); err != nil {
+        return nil, fmt.Errorf("init sqlite schema: %w", err)
+    }
+    if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS snapshot_meta (k TEXT PRIMARY KEY, v TEXT)`); err != nil {
+        return nil, fmt.Errorf("init sqlite schema: %w", err)
+    }
+    return &sqliteCacheBackend{
+        cache:  factstore.NewSimpleInMemoryStore(),
+        db:     db,
+        loaded: map[ast.PredicateSym]bool{},
+    }, nil
+}
+
+// Add writes through to SQLite so the cache can be rebuilt after a
+// restart. factstore.FactStoreWithRemove's Add returns only a bool, so a
+// write-through failure can't be propagated to the caller; at minimum log
+// it so a transient SQLite error doesn't silently desync the cache from
+// disk.
+func (s *sqliteCacheBackend) Add(a ast.Atom) bool {
+    added := s.cache.Add(a)
+    if added {
+        payload, err := json.Marshal(atomToFact(a))
+        if err != nil {
+            log.Printf("store: sqlite marshal pred=%s: %v", a.Predicate.Symbol, err)
+        } else if _, err := s.db.Exec(`INSERT OR REPLACE INTO facts(pred, arity, fact_key, payload) VALUES (?, ?, ?, ?)`,
+            a.Predicate.Symbol, a.Predicate.Arity, atomKey(a), string(payload)); err != nil {
+            log.Printf("store: sqlite write-through add pred=%s: %v", a.Predicate.Symbol, err)
+        }
+    }
+    return added
+}
+
+// Remove mirrors Add's write-through, and the same can't-propagate caveat
+// applies to its on-disk delete.
+func (s *sqliteCacheBackend) Remove(a ast.Atom) bool {
+    removed := s.cache.Remove(a)
+    if _, err := s.db.Exec(`DELETE FROM facts WHERE pred = ? AND arity = ? AND fact_key = ?`,
+        a.Predicate.Symbol, a.Predicate.Arity, atomKey(a)); err != nil {
+        log.Printf("store: sqlite write-through remove pred=%s: %v", a.Predicate.Symbol, err)
+    }
+    return removed
+}
+
+func (s *sqliteCacheBackend) GetFacts(query ast.Atom, cb func(ast.Atom) error) error {
+    if err := s.hydrate(query.Predicate); err != nil {
+        return err
+    }
+    return s.cache.GetFacts(query, cb)
+}
+
+// hydrate loads every row for pred from SQLite into the cache once; later
+// calls are served entirely from memory until the process restarts.
+func (s *sqliteCacheBackend) hydrate(pred ast.PredicateSym) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.loaded[pred] {
+        return nil
+    }
+    rows, err := s.db.Query(`SELECT payload FROM facts WHERE pred = ? AND arity = ?`, pred.Symbol, pred.Arity)
+    if err != nil {
+        return fmt.Errorf("hydrate %s: %w", pred.Symbol, err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var payload string
+        if err := rows.Scan(&payload); err != nil {
+            return err
+        }
+        var f Fact
+        if err := json.Unmarshal([]byte(payload), &f); err != nil {
+            return err
+        }
+        atom, err := jsonFactToAtom(f)
+        if err != nil {
+            return err
+        }
+        s.cache.Add(atom)
+    }
+    s.loaded[pred] = true
+    return rows.Err()
+}
+
+func (s *sqliteCacheBackend) EstimateFactCount() int {
+    return s.cache.EstimateFactCount()
+}
+
+func (s *sqliteCacheBackend) Snapshot(rulesHash string, predicates []ast.PredicateSym) error {
+    _, err := s.db.Exec(`INSERT OR REPLACE INTO snapshot_meta(k, v) VALUES ('rules_hash', ?)`, rulesHash)
+    return err
+}
+
+func (s *sqliteCacheBackend) Restore(rulesHash string, predicates []ast.PredicateSym) (bool, error) {
+    var got string
+    err := s.db.QueryRow(`SELECT v FROM snapshot_meta WHERE k = 'rules_hash'`).Scan(&got)
+    if err == sql.ErrNoRows {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    if got != rulesHash {
+        return false, nil
+    }
+    for _, pred := range predicates {
+        if err := s.hydrate(pred); err != nil {
+            return false, err
+        }
+    }
+    return true, nil
+}
+
+// Clear truncates both tables and drops the in-memory cache, so the next
+// read rehydrates from an empty database rather than the prior window's
+// (or rules version's) facts.
+func (s *sqliteCacheBackend) Clear() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := s.db.Exec(`DELETE FROM facts`); err != nil {
+        return err
+    }
+    if _, err := s.db.Exec(`DELETE FROM snapshot_meta`); err != nil {
+        return err
+    }
+    s.cache = factstore.NewSimpleInMemoryStore()
+    s.loaded = map[ast.PredicateSym]bool{}
+    return nil
+}
+
+func (s *sqliteCacheBackend) Close() error { return s.db.Close() }
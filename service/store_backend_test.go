@@ -0,0 +1,32 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/google/mangle/ast"
+)
+
+// TestMemoryBackendClearWipesFacts covers the chunk0-5 fix: LoadFacts now
+// calls Clear() instead of Close()+reopen, so the backend must actually
+// forget everything it held.
+func TestMemoryBackendClearWipesFacts(t *testing.T) {
+    b, err := newMemoryBackend(Config{})
+    if err != nil {
+        t.Fatalf("newMemoryBackend: %v", err)
+    }
+    pred := ast.PredicateSym{Symbol: "vendor_price", Arity: 1}
+    b.Add(ast.Atom{Predicate: pred, Args: []ast.BaseTerm{ast.String("c1")}})
+
+    if err := b.Clear(); err != nil {
+        t.Fatalf("Clear: %v", err)
+    }
+
+    var remaining bool
+    b.GetFacts(ast.NewQuery(pred), func(a ast.Atom) error {
+        remaining = true
+        return nil
+    })
+    if remaining {
+        t.Fatalf("expected Clear to remove all facts from a prior window")
+    }
+}